@@ -3,6 +3,7 @@ package operation
 import (
 	"bytes"
 	"code.google.com/p/weed-fs/go/glog"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -21,43 +22,58 @@ type UploadResult struct {
 	Error string
 }
 
+// UploadOptions groups the metadata that goes along with a streamed
+// upload, so callers adding a field don't need another positional
+// parameter on Upload/UploadWithContext.
+type UploadOptions struct {
+	Filename      string
+	IsGzipped     bool
+	MimeType      string
+	ModTime       int64 // unix time, 0 means unset
+	Pairs         map[string]string
+	ContentLength int64 // size of the data reader will yield, 0 means unknown
+}
+
 var fileNameEscaper = strings.NewReplacer("\\", "\\\\", "\"", "\\\"")
 
 func Upload(uploadUrl string, filename string, reader io.Reader, isGzipped bool, mtype string) (*UploadResult, error) {
-	return upload_content(uploadUrl, func(w io.Writer) (err error) {
-		_, err = io.Copy(w, reader)
-		return
-	}, filename, isGzipped, mtype)
+	return UploadWithContext(context.Background(), uploadUrl, reader, UploadOptions{
+		Filename:  filename,
+		IsGzipped: isGzipped,
+		MimeType:  mtype,
+	})
 }
-func upload_content(uploadUrl string, fillBufferFunction func(w io.Writer) error, filename string, isGzipped bool, mtype string) (*UploadResult, error) {
-	body_buf := bytes.NewBufferString("")
-	body_writer := multipart.NewWriter(body_buf)
-	h := make(textproto.MIMEHeader)
-	h.Set("Content-Disposition", fmt.Sprintf(`form-data; name="file"; filename="%s"`, fileNameEscaper.Replace(filename)))
-	if mtype == "" {
-		mtype = mime.TypeByExtension(strings.ToLower(filepath.Ext(filename)))
-	}
-	if mtype != "" {
-		h.Set("Content-Type", mtype)
-	}
-	if isGzipped {
-		h.Set("Content-Encoding", "gzip")
-	}
-	file_writer, err := body_writer.CreatePart(h)
+
+// UploadWithContext streams reader to uploadUrl as a multipart/form-data
+// request body instead of buffering it in memory first, so uploading a
+// multi-GB file doesn't allocate a multi-GB buffer in the client process.
+// ctx can be used to cancel the upload while it's in flight.
+func UploadWithContext(ctx context.Context, uploadUrl string, reader io.Reader, opt UploadOptions) (*UploadResult, error) {
+	bodyReader, bodyWriter := io.Pipe()
+	multipartWriter := multipart.NewWriter(bodyWriter)
+
+	go func() {
+		err := writeMultipartBody(multipartWriter, reader, opt)
+		if err != nil {
+			glog.V(0).Infoln("error writing multipart body", err)
+		}
+		bodyWriter.CloseWithError(err)
+	}()
+
+	req, err := http.NewRequest("POST", uploadUrl, bodyReader)
 	if err != nil {
-		glog.V(0).Infoln("error creating form file", err)
-		return nil, err
-	}
-	if err = fillBufferFunction(file_writer); err != nil {
-		glog.V(0).Infoln("error copying data", err)
+		bodyReader.CloseWithError(err) // unblock writeMultipartBody's goroutine
 		return nil, err
 	}
-	content_type := body_writer.FormDataContentType()
-	if err = body_writer.Close(); err != nil {
-		glog.V(0).Infoln("error closing body", err)
-		return nil, err
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", multipartWriter.FormDataContentType())
+	if opt.ContentLength > 0 {
+		if n, err := multipartContentLength(multipartWriter.Boundary(), opt.ContentLength, opt); err == nil {
+			req.ContentLength = n
+		}
 	}
-	resp, err := http.Post(uploadUrl, content_type, body_buf)
+
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		glog.V(0).Infoln("failing to upload to", uploadUrl)
 		return nil, err
@@ -78,3 +94,65 @@ func upload_content(uploadUrl string, fillBufferFunction func(w io.Writer) error
 	}
 	return &ret, nil
 }
+
+// writeMultipartBody copies reader into a single "file" part of
+// multipartWriter and closes it; it runs on its own goroutine, feeding
+// the io.Pipe that the outgoing http.Request reads from.
+func writeMultipartBody(multipartWriter *multipart.Writer, reader io.Reader, opt UploadOptions) error {
+	fileWriter, err := multipartWriter.CreatePart(fileHeader(opt))
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(fileWriter, reader); err != nil {
+		return err
+	}
+	return multipartWriter.Close()
+}
+
+// fileHeader builds the MIME header writeMultipartBody uses for the
+// "file" part, shared with multipartContentLength so the two never
+// disagree about what gets written.
+func fileHeader(opt UploadOptions) textproto.MIMEHeader {
+	h := make(textproto.MIMEHeader)
+	h.Set("Content-Disposition", fmt.Sprintf(`form-data; name="file"; filename="%s"`, fileNameEscaper.Replace(opt.Filename)))
+	mtype := opt.MimeType
+	if mtype == "" {
+		mtype = mime.TypeByExtension(strings.ToLower(filepath.Ext(opt.Filename)))
+	}
+	if mtype != "" {
+		h.Set("Content-Type", mtype)
+	}
+	if opt.IsGzipped {
+		h.Set("Content-Encoding", "gzip")
+	}
+	if opt.ModTime != 0 {
+		h.Set("X-Modified-Time", fmt.Sprintf("%d", opt.ModTime))
+	}
+	for k, v := range opt.Pairs {
+		h.Set(k, v)
+	}
+	return h
+}
+
+// multipartContentLength returns the exact number of bytes
+// writeMultipartBody will write for a file part holding contentLength
+// bytes of data with opt's headers, on a multipart.Writer using boundary.
+// Callers that know contentLength up front use this to set an exact
+// http.Request.ContentLength instead of forcing the request into
+// chunked transfer encoding.
+func multipartContentLength(boundary string, contentLength int64, opt UploadOptions) (int64, error) {
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	if err := mw.SetBoundary(boundary); err != nil {
+		return 0, err
+	}
+	if _, err := mw.CreatePart(fileHeader(opt)); err != nil {
+		return 0, err
+	}
+	headerLen := int64(buf.Len())
+	buf.Reset()
+	if err := mw.Close(); err != nil {
+		return 0, err
+	}
+	return headerLen + contentLength + int64(buf.Len()), nil
+}
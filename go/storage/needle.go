@@ -0,0 +1,203 @@
+package storage
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+)
+
+// Needle is one blob read back from a volume's .dat file: its raw
+// content plus the original filename/mime type it was uploaded with.
+type Needle struct {
+	Id           uint64
+	Cookie       uint32
+	Data         []byte
+	Name         []byte
+	Mime         []byte
+	LastModified uint64
+	IsGzipped    bool
+}
+
+// NeedleHeaderSize is the fixed-width prefix of every on-disk needle
+// record: a random Cookie guarding against id-guessing, the needle Id
+// (duplicated from the .idx entry so a record is self-describing), and
+// the byte length of everything that follows it, not counting padding.
+const NeedleHeaderSize = 4 + 8 + 4 // Cookie + Id + Size
+
+// Needle record body flags, gating which optional fields follow the
+// data: only fields actually set on write take up space on disk.
+const (
+	FlagGzip            = 0x01
+	FlagHasName         = 0x02
+	FlagHasMime         = 0x04
+	FlagHasLastModified = 0x08
+)
+
+// WriteNeedle serializes needle as one on-disk record --
+//
+//	Cookie(4) Id(8) Size(4) DataSize(4) Data(DataSize) Flags(1)
+//	[NameSize(1) Name] [MimeSize(1) Mime] [LastModified(8)] Checksum(4)
+//
+// -- and writes it to w, padded out to a NeedlePaddingSize multiple so
+// the next record starts at a padding boundary. It returns the record's
+// unpadded size, which is what the matching .idx entry should store.
+func WriteNeedle(w io.Writer, needle *Needle) (size uint32, err error) {
+	body := encodeNeedleBody(needle)
+
+	header := make([]byte, NeedleHeaderSize)
+	binary.BigEndian.PutUint32(header[0:4], needle.Cookie)
+	binary.BigEndian.PutUint64(header[4:12], needle.Id)
+	binary.BigEndian.PutUint32(header[12:16], uint32(len(body)))
+
+	if _, err = w.Write(header); err != nil {
+		return 0, err
+	}
+	if _, err = w.Write(body); err != nil {
+		return 0, err
+	}
+
+	size = uint32(len(header) + len(body))
+	if padding := paddedNeedleSize(size) - size; padding > 0 {
+		if _, err = w.Write(make([]byte, padding)); err != nil {
+			return 0, err
+		}
+	}
+	return size, nil
+}
+
+// paddedNeedleSize rounds a record's on-disk size up to the next
+// NeedlePaddingSize boundary.
+func paddedNeedleSize(size uint32) uint32 {
+	if rem := size % NeedlePaddingSize; rem != 0 {
+		return size + (NeedlePaddingSize - rem)
+	}
+	return size
+}
+
+func encodeNeedleBody(needle *Needle) []byte {
+	var flags byte
+	if needle.IsGzipped {
+		flags |= FlagGzip
+	}
+	if len(needle.Name) > 0 {
+		flags |= FlagHasName
+	}
+	if len(needle.Mime) > 0 {
+		flags |= FlagHasMime
+	}
+	if needle.LastModified != 0 {
+		flags |= FlagHasLastModified
+	}
+
+	payload := make([]byte, 4, 4+len(needle.Data)+1+1+len(needle.Name)+1+len(needle.Mime)+8)
+	binary.BigEndian.PutUint32(payload[0:4], uint32(len(needle.Data)))
+	payload = append(payload, needle.Data...)
+	payload = append(payload, flags)
+	if flags&FlagHasName != 0 {
+		payload = append(payload, byte(len(needle.Name)))
+		payload = append(payload, needle.Name...)
+	}
+	if flags&FlagHasMime != 0 {
+		payload = append(payload, byte(len(needle.Mime)))
+		payload = append(payload, needle.Mime...)
+	}
+	if flags&FlagHasLastModified != 0 {
+		lastModified := make([]byte, 8)
+		binary.BigEndian.PutUint64(lastModified, needle.LastModified)
+		payload = append(payload, lastModified...)
+	}
+
+	checksum := make([]byte, 4)
+	binary.BigEndian.PutUint32(checksum, crc32.ChecksumIEEE(payload))
+	return append(payload, checksum...)
+}
+
+// ReadNeedleBlob reads and parses the needle record stored at the .idx
+// entry (offset, size) from r, where offset is in NeedlePaddingSize
+// units and size is the unpadded record length written by WriteNeedle.
+// It returns an error if the entry has been tombstoned (size 0), the
+// record is truncated, or its checksum doesn't match what's on disk.
+func ReadNeedleBlob(r io.ReaderAt, offset uint32, size uint32) (*Needle, error) {
+	if size == 0 {
+		return nil, errors.New("needle has been deleted")
+	}
+	if size < NeedleHeaderSize {
+		return nil, errors.New("corrupt needle: record smaller than header")
+	}
+
+	record := make([]byte, size)
+	if _, err := r.ReadAt(record, int64(offset)*NeedlePaddingSize); err != nil {
+		return nil, err
+	}
+
+	cookie := binary.BigEndian.Uint32(record[0:4])
+	id := binary.BigEndian.Uint64(record[4:12])
+	bodySize := binary.BigEndian.Uint32(record[12:16])
+	body := record[NeedleHeaderSize:]
+	if uint32(len(body)) != bodySize {
+		return nil, errors.New("corrupt needle: body size mismatch")
+	}
+	return decodeNeedleBody(cookie, id, body)
+}
+
+func decodeNeedleBody(cookie uint32, id uint64, body []byte) (*Needle, error) {
+	if len(body) < 4+1+4 { // DataSize + Flags + Checksum, at minimum
+		return nil, errors.New("corrupt needle: data size out of range")
+	}
+
+	checksum := binary.BigEndian.Uint32(body[len(body)-4:])
+	payload := body[:len(body)-4]
+	if crc32.ChecksumIEEE(payload) != checksum {
+		return nil, errors.New("corrupt needle: checksum mismatch")
+	}
+
+	dataSize := binary.BigEndian.Uint32(payload[0:4])
+	pos := 4
+	if uint32(pos)+dataSize > uint32(len(payload)) {
+		return nil, errors.New("corrupt needle: data size out of range")
+	}
+	needle := &Needle{Id: id, Cookie: cookie, Data: payload[pos : pos+int(dataSize)]}
+	pos += int(dataSize)
+
+	if pos >= len(payload) {
+		return nil, errors.New("corrupt needle: missing flags byte")
+	}
+	flags := payload[pos]
+	pos++
+	needle.IsGzipped = flags&FlagGzip != 0
+
+	if flags&FlagHasName != 0 {
+		if pos >= len(payload) {
+			return nil, errors.New("corrupt needle: missing name length")
+		}
+		nameSize := int(payload[pos])
+		pos++
+		if pos+nameSize > len(payload) {
+			return nil, errors.New("corrupt needle: name out of range")
+		}
+		needle.Name = payload[pos : pos+nameSize]
+		pos += nameSize
+	}
+	if flags&FlagHasMime != 0 {
+		if pos >= len(payload) {
+			return nil, errors.New("corrupt needle: missing mime length")
+		}
+		mimeSize := int(payload[pos])
+		pos++
+		if pos+mimeSize > len(payload) {
+			return nil, errors.New("corrupt needle: mime out of range")
+		}
+		needle.Mime = payload[pos : pos+mimeSize]
+		pos += mimeSize
+	}
+	if flags&FlagHasLastModified != 0 {
+		if pos+8 > len(payload) {
+			return nil, errors.New("corrupt needle: last-modified out of range")
+		}
+		needle.LastModified = binary.BigEndian.Uint64(payload[pos : pos+8])
+		pos += 8
+	}
+
+	return needle, nil
+}
@@ -6,10 +6,23 @@ import (
 	"code.google.com/p/weed-fs/go/util"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strconv"
 )
 
+// NeedleMapper maps a needle's key to where it lives in the .dat file.
+// NeedleMap keeps this mapping in memory; NeedleMapLevelDB and
+// NeedleMapBoltDB keep it on disk instead, trading lookup speed for the
+// ability to hold tens of millions of needles per volume without the RAM
+// an in-memory CompactMap would need.
 type NeedleMapper interface {
+	// Put records key's (offset, size) and returns the number of bytes
+	// appended to the backing .idx log for this entry (always
+	// NeedleEntrySize, regardless of which NeedleMapper implementation
+	// is in use), so callers can account for .idx growth the same way
+	// across backends.
 	Put(key uint64, offset uint32, size uint32) (int, error)
 	Get(key uint64) (element *NeedleValue, ok bool)
 	Delete(key uint64) error
@@ -22,6 +35,83 @@ type NeedleMapper interface {
 	NextFileKey(count int) uint64
 }
 
+// IndexType selects which NeedleMapper implementation backs a volume.
+type IndexType string
+
+const (
+	NeedleMapInMemory IndexType = "memory"
+	NeedleMapLevelDb  IndexType = "leveldb"
+	NeedleMapBoltDb   IndexType = "boltdb"
+)
+
+// NewNeedleMapForIndexType opens the needle map for idxFile using the
+// backend named by indexType: an on-disk LevelDB or BoltDB store, rebuilt
+// from the .idx file if needed, or an in-memory NeedleMap for
+// NeedleMapInMemory and any unrecognized value. The volume server has no
+// command-line flag that selects indexType, and its mount handler always
+// loads an in-memory NeedleMap.
+func NewNeedleMapForIndexType(indexType IndexType, idxFile *os.File) (NeedleMapper, error) {
+	switch indexType {
+	case NeedleMapLevelDb:
+		return NewNeedleMapLevelDB(idxFile)
+	case NeedleMapBoltDb:
+		return NewNeedleMapBoltDB(idxFile)
+	default:
+		return LoadNeedleMap(idxFile)
+	}
+}
+
+// indexStoreDir returns the directory an on-disk needle map backend
+// should use to store its files, next to the .idx file it mirrors.
+func indexStoreDir(idxFile *os.File, suffix string) string {
+	return idxFile.Name() + suffix
+}
+
+// indexStoreIsStale reports whether the on-disk store at storeDir is
+// missing or out of date with idxFile, so callers know to rebuild it by
+// walking the index file from scratch.
+func indexStoreIsStale(storeDir string, idxFile *os.File) bool {
+	fi, err := idxFile.Stat()
+	if err != nil {
+		return true
+	}
+	marker, err := ioutil.ReadFile(filepath.Join(storeDir, "idx.size"))
+	if err != nil {
+		return true
+	}
+	return string(marker) != strconv.FormatInt(fi.Size(), 10)
+}
+
+// writeIndexStoreMarker records the .idx file size the on-disk store at
+// storeDir was last synced to, so a later open can tell if it went stale.
+func writeIndexStoreMarker(storeDir string, idxFile *os.File) error {
+	fi, err := idxFile.Stat()
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(storeDir, "idx.size"), []byte(strconv.FormatInt(fi.Size(), 10)), 0644)
+}
+
+// NeedleEntrySize is the fixed width of one {key, offset, size} row in a
+// .idx file: an 8-byte key, a 4-byte offset and a 4-byte size.
+const NeedleEntrySize = 8 + 4 + 4
+
+// appendIndexEntry appends one {key, offset, size} row to f, in the same
+// layout walkIndexFile reads back and NeedleMap.Put/Delete write
+// directly. The on-disk-backed NeedleMapper implementations use this so
+// .idx stays the durable log that weed compact, weed export, and weed
+// backup can always walk, regardless of which KV backend mirrors it. It
+// returns NeedleEntrySize on success, matching what NeedleMap.Put returns
+// for the same write, so NeedleMapper.Put means the same thing across
+// every backend.
+func appendIndexEntry(f *os.File, key uint64, offset, size uint32) (int, error) {
+	bytes := make([]byte, NeedleEntrySize)
+	util.Uint64toBytes(bytes[0:8], key)
+	util.Uint32toBytes(bytes[8:12], offset)
+	util.Uint32toBytes(bytes[12:16], size)
+	return f.Write(bytes)
+}
+
 type mapMetric struct {
 	DeletionCounter     int    `json:"DeletionCounter"`
 	FileCounter         int    `json:"FileCounter"`
@@ -51,8 +141,20 @@ func NewNeedleMap(file *os.File) *NeedleMap {
 
 const (
 	RowsToRead = 1024
+
+	// NeedlePaddingSize is the alignment in bytes that needle bodies are
+	// padded to in the .dat file; a needle's stored offset is its byte
+	// position in the .dat file divided by this value.
+	NeedlePaddingSize = 8
 )
 
+// WalkIndexFile exposes walkIndexFile to other packages that need to
+// iterate raw .idx entries without going through a NeedleMapper, such as
+// the backup and export commands.
+func WalkIndexFile(r io.Reader, fn func(key uint64, offset, size uint32) error) error {
+	return walkIndexFile(r, fn)
+}
+
 func LoadNeedleMap(file *os.File) (*NeedleMap, error) {
 	nm := NewNeedleMap(file)
 	e := walkIndexFile(file, func(key uint64, offset, size uint32) error {
@@ -0,0 +1,215 @@
+package storage
+
+import (
+	"os"
+
+	"code.google.com/p/weed-fs/go/glog"
+	"code.google.com/p/weed-fs/go/util"
+
+	"github.com/boltdb/bolt"
+)
+
+var needleBucket = []byte("needle_map")
+
+// NeedleMapBoltDB is a NeedleMapper backed by a BoltDB database stored
+// next to the .idx file. It offers the same on-disk tradeoff as
+// NeedleMapLevelDB for operators who'd rather standardize on Bolt.
+type NeedleMapBoltDB struct {
+	indexFile *os.File
+	db        *bolt.DB
+	dbFolder  string
+
+	// unmarkedWrites counts Put/Delete calls since the "idx.size"
+	// staleness marker was last written; see markerWriteInterval.
+	unmarkedWrites int
+
+	mapMetric
+}
+
+func NewNeedleMapBoltDB(file *os.File) (*NeedleMapBoltDB, error) {
+	dbFolder := indexStoreDir(file, ".bdb")
+	if err := os.MkdirAll(dbFolder, 0755); err != nil {
+		return nil, err
+	}
+	stale := indexStoreIsStale(dbFolder, file)
+
+	db, err := bolt.Open(dbFolder+"/needle_map.db", 0644, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Update(func(tx *bolt.Tx) error {
+		_, e := tx.CreateBucketIfNotExists(needleBucket)
+		return e
+	}); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	nm := &NeedleMapBoltDB{indexFile: file, db: db, dbFolder: dbFolder}
+
+	if stale {
+		glog.V(0).Infoln("rebuilding boltdb needle map from", file.Name(), "into", dbFolder)
+		if err := nm.rebuildFromIndex(); err != nil {
+			db.Close()
+			return nil, err
+		}
+		if err := writeIndexStoreMarker(dbFolder, file); err != nil {
+			db.Close()
+			return nil, err
+		}
+	} else {
+		if err := nm.loadMetricFromIndex(); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+
+	return nm, nil
+}
+
+func (nm *NeedleMapBoltDB) rebuildFromIndex() error {
+	return nm.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(needleBucket)
+		return walkIndexFile(nm.indexFile, func(key uint64, offset, size uint32) error {
+			nm.applyMetric(key, offset, size)
+			if offset > 0 {
+				return bucket.Put(levelDbKey(key), levelDbValue(offset, size))
+			}
+			return bucket.Delete(levelDbKey(key))
+		})
+	})
+}
+
+func (nm *NeedleMapBoltDB) loadMetricFromIndex() error {
+	return walkIndexFile(nm.indexFile, func(key uint64, offset, size uint32) error {
+		nm.applyMetric(key, offset, size)
+		return nil
+	})
+}
+
+func (nm *NeedleMapBoltDB) Put(key uint64, offset uint32, size uint32) (int, error) {
+	oldSize := uint32(0)
+	if old, ok := nm.Get(key); ok {
+		oldSize = old.Size
+	}
+	n, err := appendIndexEntry(nm.indexFile, key, offset, size)
+	if err != nil {
+		return 0, err
+	}
+	if err := nm.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(needleBucket).Put(levelDbKey(key), levelDbValue(offset, size))
+	}); err != nil {
+		return 0, err
+	}
+	if err := nm.markWrite(); err != nil {
+		return 0, err
+	}
+	nm.FileCounter++
+	nm.FileByteCounter = nm.FileByteCounter + uint64(size)
+	if oldSize > 0 {
+		nm.DeletionCounter++
+		nm.DeletionByteCounter = nm.DeletionByteCounter + uint64(oldSize)
+	}
+	return n, nil
+}
+
+// markWrite counts one Put/Delete towards markerWriteInterval, flushing
+// the staleness marker and resetting the count once it's reached. See
+// NeedleMapLevelDB.markWrite for why this is batched instead of
+// refreshed on every write.
+func (nm *NeedleMapBoltDB) markWrite() error {
+	nm.unmarkedWrites++
+	if nm.unmarkedWrites < markerWriteInterval {
+		return nil
+	}
+	if err := writeIndexStoreMarker(nm.dbFolder, nm.indexFile); err != nil {
+		return err
+	}
+	nm.unmarkedWrites = 0
+	return nil
+}
+
+func (nm *NeedleMapBoltDB) Get(key uint64) (element *NeedleValue, ok bool) {
+	var data []byte
+	nm.db.View(func(tx *bolt.Tx) error {
+		if v := tx.Bucket(needleBucket).Get(levelDbKey(key)); v != nil {
+			data = make([]byte, len(v))
+			copy(data, v)
+		}
+		return nil
+	})
+	if len(data) != 8 {
+		return nil, false
+	}
+	return &NeedleValue{
+		Key:    Key(key),
+		Offset: util.BytesToUint32(data[0:4]),
+		Size:   util.BytesToUint32(data[4:8]),
+	}, true
+}
+
+func (nm *NeedleMapBoltDB) Delete(key uint64) error {
+	if old, ok := nm.Get(key); ok {
+		nm.DeletionByteCounter = nm.DeletionByteCounter + uint64(old.Size)
+	}
+	if _, err := appendIndexEntry(nm.indexFile, key, 0, 0); err != nil {
+		return err
+	}
+	if err := nm.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(needleBucket).Delete(levelDbKey(key))
+	}); err != nil {
+		return err
+	}
+	if err := nm.markWrite(); err != nil {
+		return err
+	}
+	nm.DeletionCounter++
+	return nil
+}
+
+func (nm *NeedleMapBoltDB) Close() {
+	_ = writeIndexStoreMarker(nm.dbFolder, nm.indexFile) // flush any batched marker write
+	_ = nm.indexFile.Close()
+	_ = nm.db.Close()
+}
+
+func (nm *NeedleMapBoltDB) ContentSize() uint64 {
+	return nm.FileByteCounter
+}
+
+func (nm *NeedleMapBoltDB) DeletedSize() uint64 {
+	return nm.DeletionByteCounter
+}
+
+func (nm *NeedleMapBoltDB) FileCount() int {
+	return nm.FileCounter
+}
+
+func (nm *NeedleMapBoltDB) DeletedCount() int {
+	return nm.DeletionCounter
+}
+
+func (nm *NeedleMapBoltDB) Visit(visit func(NeedleValue) error) error {
+	return nm.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(needleBucket).ForEach(func(k, v []byte) error {
+			if len(v) != 8 {
+				return nil
+			}
+			nv := NeedleValue{
+				Key:    Key(util.BytesToUint64(k)),
+				Offset: util.BytesToUint32(v[0:4]),
+				Size:   util.BytesToUint32(v[4:8]),
+			}
+			return visit(nv)
+		})
+	})
+}
+
+func (nm *NeedleMapBoltDB) NextFileKey(count int) (ret uint64) {
+	if count <= 0 {
+		return 0
+	}
+	ret = nm.MaximumFileKey
+	nm.MaximumFileKey += uint64(count)
+	return
+}
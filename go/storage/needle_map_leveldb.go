@@ -0,0 +1,237 @@
+package storage
+
+import (
+	"os"
+
+	"code.google.com/p/weed-fs/go/glog"
+	"code.google.com/p/weed-fs/go/util"
+
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// NeedleMapLevelDB is a NeedleMapper backed by a LevelDB database stored
+// next to the .idx file, for volumes with more needles than comfortably
+// fit in an in-memory CompactMap.
+type NeedleMapLevelDB struct {
+	indexFile *os.File
+	db        *leveldb.DB
+	dbFolder  string
+
+	// unmarkedWrites counts Put/Delete calls since the "idx.size"
+	// staleness marker was last written, so it can be refreshed in
+	// batches instead of on every single needle (see writeIndexStoreMarker).
+	unmarkedWrites int
+
+	mapMetric
+}
+
+// markerWriteInterval bounds how often the on-disk backends refresh
+// their staleness marker: every call still appends to .idx and the KV
+// store, but the small "idx.size" file is only rewritten once every this
+// many writes, plus unconditionally on Close. A crash between marker
+// writes just makes the next open treat the store as stale and rebuild
+// it from .idx, which is always safe, so this is a pure batching win at
+// the scale (tens of millions of needles) these backends exist for.
+const markerWriteInterval = 1000
+
+func NewNeedleMapLevelDB(file *os.File) (*NeedleMapLevelDB, error) {
+	dbFolder := indexStoreDir(file, ".ldb")
+	stale := indexStoreIsStale(dbFolder, file)
+
+	db, err := leveldb.OpenFile(dbFolder, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	nm := &NeedleMapLevelDB{indexFile: file, db: db, dbFolder: dbFolder}
+
+	if stale {
+		glog.V(0).Infoln("rebuilding leveldb needle map from", file.Name(), "into", dbFolder)
+		if err := nm.rebuildFromIndex(); err != nil {
+			db.Close()
+			return nil, err
+		}
+		if err := writeIndexStoreMarker(dbFolder, file); err != nil {
+			db.Close()
+			return nil, err
+		}
+	} else {
+		if err := nm.loadMetricFromIndex(); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+
+	return nm, nil
+}
+
+// rebuildFromIndex walks the .idx file, replaying every entry into the
+// LevelDB store and recomputing the in-memory metrics.
+func (nm *NeedleMapLevelDB) rebuildFromIndex() error {
+	batch := new(leveldb.Batch)
+	e := walkIndexFile(nm.indexFile, func(key uint64, offset, size uint32) error {
+		nm.applyMetric(key, offset, size)
+		if offset > 0 {
+			batch.Put(levelDbKey(key), levelDbValue(offset, size))
+		} else {
+			batch.Delete(levelDbKey(key))
+		}
+		return nil
+	})
+	if e != nil {
+		return e
+	}
+	return nm.db.Write(batch, nil)
+}
+
+// loadMetricFromIndex recomputes FileCounter/DeletionCounter/etc by
+// walking the .idx file, without touching the already-synced LevelDB store.
+func (nm *NeedleMapLevelDB) loadMetricFromIndex() error {
+	return walkIndexFile(nm.indexFile, func(key uint64, offset, size uint32) error {
+		nm.applyMetric(key, offset, size)
+		return nil
+	})
+}
+
+func (nm *mapMetric) applyMetric(key uint64, offset, size uint32) {
+	if key > nm.MaximumFileKey {
+		nm.MaximumFileKey = key
+	}
+	nm.FileCounter++
+	nm.FileByteCounter = nm.FileByteCounter + uint64(size)
+	if offset == 0 {
+		nm.DeletionCounter++
+	}
+}
+
+func levelDbKey(key uint64) []byte {
+	bytes := make([]byte, 8)
+	util.Uint64toBytes(bytes, key)
+	return bytes
+}
+
+func levelDbValue(offset, size uint32) []byte {
+	bytes := make([]byte, 8)
+	util.Uint32toBytes(bytes[0:4], offset)
+	util.Uint32toBytes(bytes[4:8], size)
+	return bytes
+}
+
+func (nm *NeedleMapLevelDB) Put(key uint64, offset uint32, size uint32) (int, error) {
+	oldSize := uint32(0)
+	if old, ok := nm.Get(key); ok {
+		oldSize = old.Size
+	}
+	n, err := appendIndexEntry(nm.indexFile, key, offset, size)
+	if err != nil {
+		return 0, err
+	}
+	if err := nm.db.Put(levelDbKey(key), levelDbValue(offset, size), nil); err != nil {
+		return 0, err
+	}
+	if err := nm.markWrite(); err != nil {
+		return 0, err
+	}
+	nm.FileCounter++
+	nm.FileByteCounter = nm.FileByteCounter + uint64(size)
+	if oldSize > 0 {
+		nm.DeletionCounter++
+		nm.DeletionByteCounter = nm.DeletionByteCounter + uint64(oldSize)
+	}
+	return n, nil
+}
+
+// markWrite counts one Put/Delete towards markerWriteInterval, flushing
+// the staleness marker and resetting the count once it's reached.
+func (nm *NeedleMapLevelDB) markWrite() error {
+	nm.unmarkedWrites++
+	if nm.unmarkedWrites < markerWriteInterval {
+		return nil
+	}
+	if err := writeIndexStoreMarker(nm.dbFolder, nm.indexFile); err != nil {
+		return err
+	}
+	nm.unmarkedWrites = 0
+	return nil
+}
+
+func (nm *NeedleMapLevelDB) Get(key uint64) (element *NeedleValue, ok bool) {
+	data, err := nm.db.Get(levelDbKey(key), nil)
+	if err != nil || len(data) != 8 {
+		return nil, false
+	}
+	return &NeedleValue{
+		Key:    Key(key),
+		Offset: util.BytesToUint32(data[0:4]),
+		Size:   util.BytesToUint32(data[4:8]),
+	}, true
+}
+
+func (nm *NeedleMapLevelDB) Delete(key uint64) error {
+	if old, ok := nm.Get(key); ok {
+		nm.DeletionByteCounter = nm.DeletionByteCounter + uint64(old.Size)
+	}
+	if _, err := appendIndexEntry(nm.indexFile, key, 0, 0); err != nil {
+		return err
+	}
+	if err := nm.db.Delete(levelDbKey(key), nil); err != nil {
+		return err
+	}
+	if err := nm.markWrite(); err != nil {
+		return err
+	}
+	nm.DeletionCounter++
+	return nil
+}
+
+func (nm *NeedleMapLevelDB) Close() {
+	_ = writeIndexStoreMarker(nm.dbFolder, nm.indexFile) // flush any batched marker write
+	_ = nm.indexFile.Close()
+	_ = nm.db.Close()
+}
+
+func (nm *NeedleMapLevelDB) ContentSize() uint64 {
+	return nm.FileByteCounter
+}
+
+func (nm *NeedleMapLevelDB) DeletedSize() uint64 {
+	return nm.DeletionByteCounter
+}
+
+func (nm *NeedleMapLevelDB) FileCount() int {
+	return nm.FileCounter
+}
+
+func (nm *NeedleMapLevelDB) DeletedCount() int {
+	return nm.DeletionCounter
+}
+
+func (nm *NeedleMapLevelDB) Visit(visit func(NeedleValue) error) error {
+	iter := nm.db.NewIterator(nil, nil)
+	defer iter.Release()
+	for iter.Next() {
+		key := util.BytesToUint64(iter.Key())
+		value := iter.Value()
+		if len(value) != 8 {
+			continue
+		}
+		nv := NeedleValue{
+			Key:    Key(key),
+			Offset: util.BytesToUint32(value[0:4]),
+			Size:   util.BytesToUint32(value[4:8]),
+		}
+		if err := visit(nv); err != nil {
+			return err
+		}
+	}
+	return iter.Error()
+}
+
+func (nm *NeedleMapLevelDB) NextFileKey(count int) (ret uint64) {
+	if count <= 0 {
+		return 0
+	}
+	ret = nm.MaximumFileKey
+	nm.MaximumFileKey += uint64(count)
+	return
+}
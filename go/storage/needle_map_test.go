@@ -0,0 +1,187 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// openIndexFile creates a fresh, empty .idx file inside a temp directory
+// that is removed when the test completes.
+func openIndexFile(t *testing.T) *os.File {
+	dir, err := ioutil.TempDir("", "needle_map_test")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	f, err := os.OpenFile(filepath.Join(dir, "1.idx"), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		t.Fatalf("open idx file: %s", err)
+	}
+	t.Cleanup(func() { f.Close() })
+	return f
+}
+
+// needleMappers returns one freshly-opened NeedleMapper of each backend,
+// so the Put/Get/Delete/Visit tests below run identically against all of
+// them and catch any backend that drifts from NeedleMap's behavior.
+func needleMappers(t *testing.T) map[string]NeedleMapper {
+	mappers := make(map[string]NeedleMapper)
+
+	mappers["memory"] = NewNeedleMap(openIndexFile(t))
+
+	leveldb, err := NewNeedleMapLevelDB(openIndexFile(t))
+	if err != nil {
+		t.Fatalf("NewNeedleMapLevelDB: %s", err)
+	}
+	mappers["leveldb"] = leveldb
+
+	boltdb, err := NewNeedleMapBoltDB(openIndexFile(t))
+	if err != nil {
+		t.Fatalf("NewNeedleMapBoltDB: %s", err)
+	}
+	mappers["boltdb"] = boltdb
+
+	return mappers
+}
+
+func TestNeedleMapPutGet(t *testing.T) {
+	for name, nm := range needleMappers(t) {
+		nm := nm
+		t.Run(name, func(t *testing.T) {
+			n, err := nm.Put(1, 10, 100)
+			if err != nil {
+				t.Fatalf("Put: %s", err)
+			}
+			if n != NeedleEntrySize {
+				t.Fatalf("Put(...) = %d, want NeedleEntrySize (%d) for every backend", n, NeedleEntrySize)
+			}
+			element, ok := nm.Get(1)
+			if !ok {
+				t.Fatalf("Get(1) not found after Put")
+			}
+			if element.Offset != 10 || element.Size != 100 {
+				t.Fatalf("Get(1) = (%d, %d), want (10, 100)", element.Offset, element.Size)
+			}
+			if nm.FileCount() != 1 {
+				t.Fatalf("FileCount() = %d, want 1", nm.FileCount())
+			}
+			if nm.ContentSize() != 100 {
+				t.Fatalf("ContentSize() = %d, want 100", nm.ContentSize())
+			}
+		})
+	}
+}
+
+func TestNeedleMapDelete(t *testing.T) {
+	for name, nm := range needleMappers(t) {
+		nm := nm
+		t.Run(name, func(t *testing.T) {
+			if _, err := nm.Put(1, 10, 100); err != nil {
+				t.Fatalf("Put: %s", err)
+			}
+			if err := nm.Delete(1); err != nil {
+				t.Fatalf("Delete: %s", err)
+			}
+			if nm.DeletedCount() != 1 {
+				t.Fatalf("DeletedCount() = %d, want 1", nm.DeletedCount())
+			}
+			if nm.DeletedSize() != 100 {
+				t.Fatalf("DeletedSize() = %d, want 100", nm.DeletedSize())
+			}
+		})
+	}
+}
+
+func TestNeedleMapVisit(t *testing.T) {
+	for name, nm := range needleMappers(t) {
+		nm := nm
+		t.Run(name, func(t *testing.T) {
+			if _, err := nm.Put(1, 10, 100); err != nil {
+				t.Fatalf("Put: %s", err)
+			}
+			if _, err := nm.Put(2, 20, 200); err != nil {
+				t.Fatalf("Put: %s", err)
+			}
+			if err := nm.Delete(2); err != nil {
+				t.Fatalf("Delete: %s", err)
+			}
+
+			seen := make(map[uint64]NeedleValue)
+			if err := nm.Visit(func(nv NeedleValue) error {
+				seen[uint64(nv.Key)] = nv
+				return nil
+			}); err != nil {
+				t.Fatalf("Visit: %s", err)
+			}
+			if _, ok := seen[1]; !ok {
+				t.Fatalf("Visit skipped live key 1")
+			}
+			if _, ok := seen[2]; ok {
+				t.Fatalf("Visit surfaced deleted key 2")
+			}
+		})
+	}
+}
+
+// TestNeedleMapReopenReplaysIndex checks that the on-disk backends
+// (NeedleMapLevelDB, NeedleMapBoltDB) write every Put/Delete through to
+// the .idx file, so closing and reopening from just that file replays
+// the same state a NeedleMap would have kept in memory all along.
+func TestNeedleMapReopenReplaysIndex(t *testing.T) {
+	reopen := map[string]func(*os.File) (NeedleMapper, error){
+		"leveldb": func(f *os.File) (NeedleMapper, error) { return NewNeedleMapLevelDB(f) },
+		"boltdb":  func(f *os.File) (NeedleMapper, error) { return NewNeedleMapBoltDB(f) },
+	}
+
+	for name, open := range reopen {
+		open := open
+		t.Run(name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "needle_map_test")
+			if err != nil {
+				t.Fatalf("TempDir: %s", err)
+			}
+			t.Cleanup(func() { os.RemoveAll(dir) })
+			idxPath := filepath.Join(dir, "1.idx")
+
+			f, err := os.OpenFile(idxPath, os.O_RDWR|os.O_CREATE, 0644)
+			if err != nil {
+				t.Fatalf("open idx file: %s", err)
+			}
+			nm, err := open(f)
+			if err != nil {
+				t.Fatalf("open: %s", err)
+			}
+			if _, err := nm.Put(1, 10, 100); err != nil {
+				t.Fatalf("Put: %s", err)
+			}
+			if _, err := nm.Put(2, 20, 200); err != nil {
+				t.Fatalf("Put: %s", err)
+			}
+			if err := nm.Delete(2); err != nil {
+				t.Fatalf("Delete: %s", err)
+			}
+			nm.Close()
+
+			f, err = os.OpenFile(idxPath, os.O_RDWR, 0644)
+			if err != nil {
+				t.Fatalf("reopen idx file: %s", err)
+			}
+			t.Cleanup(func() { f.Close() })
+
+			reloaded, err := LoadNeedleMap(f)
+			if err != nil {
+				t.Fatalf("LoadNeedleMap: %s", err)
+			}
+			element, ok := reloaded.Get(1)
+			if !ok || element.Offset != 10 || element.Size != 100 {
+				t.Fatalf("LoadNeedleMap lost live key 1: ok=%v element=%+v", ok, element)
+			}
+			if _, ok := reloaded.Get(2); ok {
+				t.Fatalf("LoadNeedleMap resurrected deleted key 2")
+			}
+		})
+	}
+}
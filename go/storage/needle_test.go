@@ -0,0 +1,72 @@
+package storage
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestNeedleRoundTrip(t *testing.T) {
+	cases := []*Needle{
+		{Id: 1, Cookie: 0xcafebabe, Data: []byte("hello world")},
+		{Id: 2, Cookie: 0x1, Data: []byte("with metadata"), Name: []byte("a.txt"), Mime: []byte("text/plain"), LastModified: 1234567890},
+		{Id: 3, Cookie: 0x2, Data: []byte{}, IsGzipped: true},
+	}
+
+	var buf bytes.Buffer
+	offsets := make([]uint32, len(cases))
+	sizes := make([]uint32, len(cases))
+	for i, n := range cases {
+		offsets[i] = uint32(buf.Len()) / NeedlePaddingSize
+		size, err := WriteNeedle(&buf, n)
+		if err != nil {
+			t.Fatalf("WriteNeedle: %s", err)
+		}
+		sizes[i] = size
+	}
+
+	r := bytes.NewReader(buf.Bytes())
+	for i, want := range cases {
+		got, err := ReadNeedleBlob(r, offsets[i], sizes[i])
+		if err != nil {
+			t.Fatalf("ReadNeedleBlob(%d): %s", i, err)
+		}
+		if got.Id != want.Id || got.Cookie != want.Cookie {
+			t.Fatalf("case %d: Id/Cookie = %d/%x, want %d/%x", i, got.Id, got.Cookie, want.Id, want.Cookie)
+		}
+		if !bytes.Equal(got.Data, want.Data) {
+			t.Fatalf("case %d: Data = %q, want %q", i, got.Data, want.Data)
+		}
+		if string(got.Name) != string(want.Name) {
+			t.Fatalf("case %d: Name = %q, want %q", i, got.Name, want.Name)
+		}
+		if string(got.Mime) != string(want.Mime) {
+			t.Fatalf("case %d: Mime = %q, want %q", i, got.Mime, want.Mime)
+		}
+		if got.LastModified != want.LastModified {
+			t.Fatalf("case %d: LastModified = %d, want %d", i, got.LastModified, want.LastModified)
+		}
+		if got.IsGzipped != want.IsGzipped {
+			t.Fatalf("case %d: IsGzipped = %v, want %v", i, got.IsGzipped, want.IsGzipped)
+		}
+	}
+}
+
+func TestReadNeedleBlobTombstoned(t *testing.T) {
+	if _, err := ReadNeedleBlob(bytes.NewReader(nil), 0, 0); err == nil {
+		t.Fatal("expected error reading a tombstoned (size 0) entry")
+	}
+}
+
+func TestReadNeedleBlobChecksumMismatch(t *testing.T) {
+	var buf bytes.Buffer
+	size, err := WriteNeedle(&buf, &Needle{Id: 1, Cookie: 1, Data: []byte("data")})
+	if err != nil {
+		t.Fatalf("WriteNeedle: %s", err)
+	}
+	corrupt := buf.Bytes()
+	corrupt[NeedleHeaderSize+4] ^= 0xff // flip a byte inside Data
+
+	if _, err := ReadNeedleBlob(bytes.NewReader(corrupt), 0, size); err == nil {
+		t.Fatal("expected checksum mismatch error on corrupted record")
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"code.google.com/p/weed-fs/go/glog"
+	"code.google.com/p/weed-fs/go/storage"
+	"code.google.com/p/weed-fs/go/util"
+)
+
+func init() {
+	cmdBackup.Run = runBackup // break init cycle
+}
+
+var cmdBackup = &Command{
+	UsageLine: "backup -dir=/tmp -volumeId=234 -server=localhost:8080",
+	Short:     "incrementally mirror a volume from a remote source",
+	Long: `Incrementally pull the new needles of a volume from a source volume
+  server, so this copy can be used as an asynchronous replication follower.
+
+  Each run asks the source for its current (CompactRevision, IdxFileSize,
+  TailOffset), appends any .idx entries and matching needle bodies the
+  follower is missing, and exits. If the source has compacted since the
+  last run, the local copy is discarded and re-synced from scratch.
+
+  `,
+}
+
+var (
+	backupVolumePath    = cmdBackup.Flag.String("dir", "/tmp", "data directory to store the backup in")
+	backupVolumeIdxPath = cmdBackup.Flag.String("dir.idx", "", "directory to store .idx files, default to the same as -dir")
+	backupVolumeId      = cmdBackup.Flag.Int("volumeId", -1, "a volume id. Created locally on first backup.")
+	backupServer        = cmdBackup.Flag.String("server", "localhost:8080", "source volume server to sync from")
+)
+
+// syncStatus mirrors the JSON returned by the source's /admin/sync/status.
+type syncStatus struct {
+	CompactRevision int   `json:"CompactRevision"`
+	IdxFileSize     int64 `json:"IdxFileSize"`
+	TailOffset      int64 `json:"TailOffset"`
+}
+
+func runBackup(cmd *Command, args []string) bool {
+	if *backupVolumeId == -1 {
+		return false
+	}
+
+	idxDir := *backupVolumeIdxPath
+	if idxDir == "" {
+		idxDir = *backupVolumePath
+	}
+	vid := storage.VolumeId(*backupVolumeId)
+
+	idxFileName := filepath.Join(idxDir, vid.String()+".idx")
+	datFileName := filepath.Join(*backupVolumePath, vid.String()+".dat")
+	revFileName := idxFileName + ".rev"
+
+	status, err := fetchSyncStatus(*backupServer, vid)
+	if err != nil {
+		glog.Fatalf("sync status [ERROR] %s\n", err)
+	}
+
+	if localRevisionIsStale(revFileName, status.CompactRevision) {
+		glog.V(0).Infoln("vid", vid, "source compacted to revision", status.CompactRevision, ", re-syncing from scratch")
+		os.Remove(idxFileName)
+		os.Remove(datFileName)
+	}
+
+	localIdxSize := fileSize(idxFileName)
+	localDatSize := fileSize(datFileName)
+
+	if status.IdxFileSize <= localIdxSize {
+		glog.V(0).Infoln("vid", vid, "already up to date at", localIdxSize, "bytes")
+		return true
+	}
+
+	newIdxBytes, err := fetchSyncRange(*backupServer, vid, "index", localIdxSize, status.IdxFileSize-localIdxSize)
+	if err != nil {
+		glog.Fatalf("fetch index [ERROR] %s\n", err)
+	}
+
+	datFile, err := os.OpenFile(datFileName, os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		glog.Fatalf("open dat file [ERROR] %s\n", err)
+	}
+	defer datFile.Close()
+	if _, err = datFile.Seek(localDatSize, 0); err != nil {
+		glog.Fatalf("seek dat file [ERROR] %s\n", err)
+	}
+
+	// The fetched .idx bytes encode the source's offsets, which are only
+	// meaningful against the source's own .dat layout. Re-derive each
+	// entry's offset from the follower's own (padded) write position as
+	// we append bodies locally, instead of copying the source's offsets
+	// through, so the local .idx keeps pointing at the right bytes.
+	localDatPos := localDatSize
+	localIdxBytes := make([]byte, 0, len(newIdxBytes))
+	err = storage.WalkIndexFile(bytes.NewReader(newIdxBytes), func(key uint64, offset, size uint32) error {
+		if offset == 0 || size == 0 {
+			localIdxBytes = append(localIdxBytes, idxEntryBytes(key, 0, 0)...)
+			return nil
+		}
+		body, err := fetchSyncRange(*backupServer, vid, "data", int64(offset)*storage.NeedlePaddingSize, int64(size))
+		if err != nil {
+			return fmt.Errorf("fetch needle %d: %s", key, err)
+		}
+		localOffset := uint32(localDatPos / storage.NeedlePaddingSize)
+		if _, err = datFile.Write(body); err != nil {
+			return err
+		}
+		padding := paddedSize(uint32(len(body))) - uint32(len(body))
+		if padding > 0 {
+			if _, err = datFile.Write(make([]byte, padding)); err != nil {
+				return err
+			}
+		}
+		localDatPos += int64(len(body)) + int64(padding)
+		localIdxBytes = append(localIdxBytes, idxEntryBytes(key, localOffset, size)...)
+		return nil
+	})
+	if err != nil {
+		glog.Fatalf("sync data [ERROR] %s\n", err)
+	}
+
+	idxFile, err := os.OpenFile(idxFileName, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		glog.Fatalf("open index file [ERROR] %s\n", err)
+	}
+	defer idxFile.Close()
+	if _, err = idxFile.Write(localIdxBytes); err != nil {
+		glog.Fatalf("write index [ERROR] %s\n", err)
+	}
+	if err = ioutil.WriteFile(revFileName, []byte(strconv.Itoa(status.CompactRevision)), 0644); err != nil {
+		glog.Fatalf("write revision marker [ERROR] %s\n", err)
+	}
+
+	glog.V(0).Infoln("vid", vid, "synced", len(newIdxBytes), "bytes of index from", *backupServer)
+
+	return true
+}
+
+func fetchSyncStatus(server string, vid storage.VolumeId) (*syncStatus, error) {
+	values := url.Values{"volume": {vid.String()}}
+	resp, err := http.Get("http://" + server + "/admin/sync/status?" + values.Encode())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	var status syncStatus
+	if err := json.Unmarshal(body, &status); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+func fetchSyncRange(server string, vid storage.VolumeId, kind string, offset, size int64) ([]byte, error) {
+	values := url.Values{
+		"volume": {vid.String()},
+		"offset": {strconv.FormatInt(offset, 10)},
+		"size":   {strconv.FormatInt(size, 10)},
+	}
+	resp, err := http.Get("http://" + server + "/admin/sync/" + kind + "?" + values.Encode())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return ioutil.ReadAll(resp.Body)
+}
+
+func localRevisionIsStale(revFileName string, sourceRevision int) bool {
+	data, err := ioutil.ReadFile(revFileName)
+	if err != nil {
+		return false
+	}
+	localRevision, err := strconv.Atoi(string(data))
+	if err != nil {
+		return true
+	}
+	return localRevision != sourceRevision
+}
+
+func fileSize(name string) int64 {
+	fi, err := os.Stat(name)
+	if err != nil {
+		return 0
+	}
+	return fi.Size()
+}
+
+// idxEntryBytes encodes one .idx row, matching the layout walkIndexFile
+// reads back (key, offset, size as 8/4/4 big-endian bytes).
+func idxEntryBytes(key uint64, offset, size uint32) []byte {
+	b := make([]byte, 16)
+	util.Uint64toBytes(b[0:8], key)
+	util.Uint32toBytes(b[8:12], offset)
+	util.Uint32toBytes(b[12:16], size)
+	return b
+}
+
+// paddedSize rounds size up to the next NeedlePaddingSize boundary, the
+// same alignment the stored offsets are expressed in.
+func paddedSize(size uint32) uint32 {
+	remainder := size % storage.NeedlePaddingSize
+	if remainder == 0 {
+		return size
+	}
+	return size + storage.NeedlePaddingSize - remainder
+}
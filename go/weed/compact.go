@@ -1,6 +1,10 @@
 package main
 
 import (
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+
 	"code.google.com/p/weed-fs/go/glog"
 	"code.google.com/p/weed-fs/go/storage"
 )
@@ -40,5 +44,27 @@ func runCompact(cmd *Command, args []string) bool {
 		glog.Fatalf("Compact Volume [ERROR] %s\n", err)
 	}
 
+	idxFileName := filepath.Join(*compactVolumePath, vid.String()+".idx")
+	if err = bumpCompactRevision(idxFileName); err != nil {
+		glog.Fatalf("Bump compact revision [ERROR] %s\n", err)
+	}
+
 	return true
 }
+
+// bumpCompactRevision records that idxFileName's volume was just
+// compacted, by incrementing a ".rev" marker next to it. The volume
+// server's /admin/sync/status handler reports this revision so that
+// "weed backup" followers know to discard their local copy and re-sync
+// from scratch whenever it changes.
+func bumpCompactRevision(idxFileName string) error {
+	revFileName := idxFileName + ".rev"
+	revision := 0
+	if data, err := ioutil.ReadFile(revFileName); err == nil {
+		if n, err := strconv.Atoi(string(data)); err == nil {
+			revision = n
+		}
+	}
+	revision++
+	return ioutil.WriteFile(revFileName, []byte(strconv.Itoa(revision)), 0644)
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"archive/tar"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"code.google.com/p/weed-fs/go/glog"
+	"code.google.com/p/weed-fs/go/storage"
+)
+
+func init() {
+	cmdExport.Run = runExport // break init cycle
+}
+
+var cmdExport = &Command{
+	UsageLine: "export -dir=/tmp -volumeId=234 -o=234.tar",
+	Short:     "export a volume's live needles without a running cluster",
+	Long: `Walk a volume's .idx file and read each live needle from its .dat file,
+  writing them out either as one tar stream (-o) or as individual files
+  in a directory (-dir.out). Tombstoned entries are skipped. This lets
+  operators recover data from a volume with no cluster running, and
+  migrate content between installations.
+
+  `,
+}
+
+var (
+	exportVolumePath = cmdExport.Flag.String("dir", "/tmp", "data directory to export from")
+	exportVolumeId   = cmdExport.Flag.Int("volumeId", -1, "a volume id. The volume should already exist in the dir.")
+	exportTarFile    = cmdExport.Flag.String("o", "", "write a tar file here")
+	exportOutputDir  = cmdExport.Flag.String("dir.out", "", "write individual files into this directory")
+)
+
+func runExport(cmd *Command, args []string) bool {
+	if *exportVolumeId == -1 {
+		return false
+	}
+	if (*exportTarFile == "") == (*exportOutputDir == "") {
+		glog.Fatalf("specify exactly one of -o or -dir.out\n")
+	}
+
+	vid := storage.VolumeId(*exportVolumeId)
+	idxFileName := filepath.Join(*exportVolumePath, vid.String()+".idx")
+	datFileName := filepath.Join(*exportVolumePath, vid.String()+".dat")
+
+	idxFile, err := os.Open(idxFileName)
+	if err != nil {
+		glog.Fatalf("Open index file [ERROR] %s\n", err)
+	}
+	defer idxFile.Close()
+
+	datFile, err := os.Open(datFileName)
+	if err != nil {
+		glog.Fatalf("Open data file [ERROR] %s\n", err)
+	}
+	defer datFile.Close()
+
+	var tarWriter *tar.Writer
+	if *exportTarFile != "" {
+		out, err := os.Create(*exportTarFile)
+		if err != nil {
+			glog.Fatalf("Create tar file [ERROR] %s\n", err)
+		}
+		defer out.Close()
+		tarWriter = tar.NewWriter(out)
+		defer tarWriter.Close()
+	} else if err := os.MkdirAll(*exportOutputDir, 0755); err != nil {
+		glog.Fatalf("Create output directory [ERROR] %s\n", err)
+	}
+
+	err = storage.WalkIndexFile(idxFile, func(key uint64, offset, size uint32) error {
+		if offset == 0 || size == 0 {
+			return nil // tombstoned
+		}
+		needle, err := storage.ReadNeedleBlob(datFile, offset, size)
+		if err != nil {
+			glog.V(0).Infoln("skipping needle", key, ":", err)
+			return nil
+		}
+		return writeNeedle(tarWriter, key, needle)
+	})
+	if err != nil {
+		glog.Fatalf("Export [ERROR] %s\n", err)
+	}
+
+	return true
+}
+
+func writeNeedle(tarWriter *tar.Writer, key uint64, needle *storage.Needle) error {
+	name := string(needle.Name)
+	if name == "" {
+		name = fmt.Sprintf("%d", key)
+	}
+	if tarWriter != nil {
+		hdr := &tar.Header{
+			Name:    fmt.Sprintf("%d#%s#%s", key, needle.Mime, name),
+			Mode:    0644,
+			Size:    int64(len(needle.Data)),
+			ModTime: time.Unix(int64(needle.LastModified), 0),
+		}
+		if err := tarWriter.WriteHeader(hdr); err != nil {
+			return err
+		}
+		_, err := tarWriter.Write(needle.Data)
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(*exportOutputDir, safeExportName(name, key)), needle.Data, 0644)
+}
+
+// safeExportName collapses a needle's stored filename down to a single
+// path element, so a needle uploaded with a name like "../../etc/cron.d/x"
+// can't escape -dir.out. Names that sanitize away to nothing or "." fall
+// back to the needle's key, same as an empty stored name.
+func safeExportName(name string, key uint64) string {
+	base := filepath.Base(filepath.Clean(name))
+	if base == "" || base == "." || base == string(filepath.Separator) {
+		return fmt.Sprintf("%d", key)
+	}
+	return base
+}
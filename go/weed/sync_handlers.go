@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"code.google.com/p/weed-fs/go/glog"
+)
+
+// registerSyncHandlers wires up /admin/sync/status, /admin/sync/index, and
+// /admin/sync/data — the read-only endpoints "weed backup" polls to
+// incrementally mirror a volume's .idx and .dat files. Called from
+// runVolume alongside registerVolumeAdminHandlers, so both sets of
+// endpoints serve off the same running volume server and the same
+// -dir/-dir.idx, instead of a separate standalone process.
+func registerSyncHandlers(dataDir, idxDir string) {
+	http.HandleFunc("/admin/sync/status", func(w http.ResponseWriter, r *http.Request) {
+		handleSyncStatus(w, r, dataDir, idxDir)
+	})
+	http.HandleFunc("/admin/sync/index", func(w http.ResponseWriter, r *http.Request) {
+		handleSyncRange(w, r, filepath.Join(idxDir, r.FormValue("volume")+".idx"))
+	})
+	http.HandleFunc("/admin/sync/data", func(w http.ResponseWriter, r *http.Request) {
+		handleSyncRange(w, r, filepath.Join(dataDir, r.FormValue("volume")+".dat"))
+	})
+}
+
+// handleSyncStatus answers /admin/sync/status with the (CompactRevision,
+// IdxFileSize, TailOffset) triple a weed backup follower compares against
+// its own local copy.
+func handleSyncStatus(w http.ResponseWriter, r *http.Request, dataDir, idxDir string) {
+	vid := r.FormValue("volume")
+	idxFileName := filepath.Join(idxDir, vid+".idx")
+
+	var status syncStatus
+	if fi, err := os.Stat(idxFileName); err == nil {
+		status.IdxFileSize = fi.Size()
+	}
+	if fi, err := os.Stat(filepath.Join(dataDir, vid+".dat")); err == nil {
+		status.TailOffset = fi.Size()
+	}
+	if data, err := ioutil.ReadFile(idxFileName + ".rev"); err == nil {
+		if n, err := strconv.Atoi(string(data)); err == nil {
+			status.CompactRevision = n
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+// handleSyncRange answers /admin/sync/index and /admin/sync/data,
+// streaming the [offset, offset+size) byte range of path back to the
+// caller.
+func handleSyncRange(w http.ResponseWriter, r *http.Request, path string) {
+	offset, _ := strconv.ParseInt(r.FormValue("offset"), 10, 64)
+	size, _ := strconv.ParseInt(r.FormValue("size"), 10, 64)
+
+	f, err := os.Open(path)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	defer f.Close()
+
+	if _, err := f.Seek(offset, 0); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if _, err := io.CopyN(w, f, size); err != nil && err != io.EOF {
+		glog.V(0).Infoln("serving", path, "[ERROR]", err)
+	}
+}
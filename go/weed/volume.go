@@ -0,0 +1,48 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+
+	"code.google.com/p/weed-fs/go/glog"
+)
+
+func init() {
+	cmdVolume.Run = runVolume // break init cycle
+}
+
+var cmdVolume = &Command{
+	UsageLine: "volume -dir=/tmp -port=8080",
+	Short:     "run a volume server",
+	Long: `Serve the /admin/volume/* endpoints operators use to mount, unmount,
+  or delete a volume without bouncing this process, plus the read-only
+  /admin/sync/* endpoints "weed backup" polls to mirror this volume
+  server's .idx and .dat files.
+
+  `,
+}
+
+var (
+	volumeDataPath = cmdVolume.Flag.String("dir", "/tmp", "data directory to store files")
+	volumeIdxPath  = cmdVolume.Flag.String("dir.idx", "", "directory to store .idx files, default to the same as -dir")
+	volumePort     = cmdVolume.Flag.Int("port", 8080, "port to listen on")
+)
+
+func volumeIdxDir() string {
+	if *volumeIdxPath == "" {
+		return *volumeDataPath
+	}
+	return *volumeIdxPath
+}
+
+func runVolume(cmd *Command, args []string) bool {
+	registerVolumeAdminHandlers()
+	registerSyncHandlers(*volumeDataPath, volumeIdxDir())
+
+	glog.V(0).Infoln("volume server listening on port", *volumePort)
+	if err := http.ListenAndServe(":"+strconv.Itoa(*volumePort), nil); err != nil {
+		glog.Fatalf("volume server [ERROR] %s\n", err)
+	}
+
+	return true
+}
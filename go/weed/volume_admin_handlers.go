@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+
+	"code.google.com/p/weed-fs/go/glog"
+	"code.google.com/p/weed-fs/go/storage"
+)
+
+// mountedVolume tracks the open handles a volume needs while it's in
+// rotation, so unmount can close them and mount can reopen them without
+// bouncing the whole process.
+type mountedVolume struct {
+	needleMap storage.NeedleMapper
+	datFile   *os.File
+}
+
+var (
+	adminVolumeLock sync.Mutex
+	adminMounted    = make(map[storage.VolumeId]*mountedVolume)
+)
+
+// registerVolumeAdminHandlers wires up /admin/volume/mount, /unmount and
+// /delete. Called explicitly from runVolume rather than via init(), so
+// these routes only ever serve off this volume server's own -dir/-dir.idx,
+// never another command's.
+func registerVolumeAdminHandlers() {
+	http.HandleFunc("/admin/volume/mount", handleMountVolume)
+	http.HandleFunc("/admin/volume/unmount", handleUnmountVolume)
+	http.HandleFunc("/admin/volume/delete", handleDeleteVolume)
+}
+
+func handleMountVolume(w http.ResponseWriter, r *http.Request) {
+	vid, err := parseAdminVolumeId(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	adminVolumeLock.Lock()
+	defer adminVolumeLock.Unlock()
+
+	if _, ok := adminMounted[vid]; ok {
+		writeAdminOK(w)
+		return
+	}
+
+	idxFile, err := os.OpenFile(filepath.Join(volumeIdxDir(), vid.String()+".idx"), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	needleMap, err := storage.LoadNeedleMap(idxFile)
+	if err != nil {
+		idxFile.Close()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	datFile, err := os.OpenFile(filepath.Join(*volumeDataPath, vid.String()+".dat"), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		needleMap.Close()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	adminMounted[vid] = &mountedVolume{needleMap: needleMap, datFile: datFile}
+	glog.V(0).Infoln("mounted volume", vid)
+	writeAdminOK(w)
+}
+
+func handleUnmountVolume(w http.ResponseWriter, r *http.Request) {
+	vid, err := parseAdminVolumeId(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	unmountAdminVolume(vid)
+	glog.V(0).Infoln("unmounted volume", vid)
+	writeAdminOK(w)
+}
+
+func handleDeleteVolume(w http.ResponseWriter, r *http.Request) {
+	vid, err := parseAdminVolumeId(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	unmountAdminVolume(vid)
+
+	os.Remove(filepath.Join(volumeIdxDir(), vid.String()+".idx"))
+	os.Remove(filepath.Join(*volumeDataPath, vid.String()+".dat"))
+
+	glog.V(0).Infoln("deleted volume", vid)
+	writeAdminOK(w)
+}
+
+// unmountAdminVolume closes vid's open handles, if any, so this volume
+// server stops serving reads/writes for it. It does not touch any
+// master/topology-level replication accounting: no master process is
+// part of this series, so there is nothing else to notify. Wiring
+// mount/unmount into a topology.VolumeLayout's writable-volume tracking
+// is the master's job, not this handler's.
+func unmountAdminVolume(vid storage.VolumeId) {
+	adminVolumeLock.Lock()
+	defer adminVolumeLock.Unlock()
+
+	if mounted, ok := adminMounted[vid]; ok {
+		mounted.needleMap.Close()
+		mounted.datFile.Close()
+		delete(adminMounted, vid)
+	}
+}
+
+func parseAdminVolumeId(r *http.Request) (storage.VolumeId, error) {
+	id, err := strconv.Atoi(r.FormValue("volume"))
+	if err != nil {
+		return 0, err
+	}
+	return storage.VolumeId(id), nil
+}
+
+func writeAdminOK(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]bool{"Ok": true})
+}
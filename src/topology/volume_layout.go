@@ -1,16 +1,17 @@
 package topology
 
 import (
-	"storage"
 	"errors"
 	"fmt"
-	"math/rand"
+	"storage"
 )
 
 type VolumeLayout struct {
 	repType         storage.ReplicationType
 	vid2location    map[storage.VolumeId]*VolumeLocationList
 	writables       []storage.VolumeId // transient array of writable volume id
+	vid2size        map[storage.VolumeId]uint64
+	picker          VolumePicker
 	pulse           int64
 	volumeSizeLimit uint64
 }
@@ -20,15 +21,24 @@ func NewVolumeLayout(repType storage.ReplicationType, volumeSizeLimit uint64, pu
 		repType:         repType,
 		vid2location:    make(map[storage.VolumeId]*VolumeLocationList),
 		writables:       *new([]storage.VolumeId),
+		vid2size:        make(map[storage.VolumeId]uint64),
+		picker:          RandomPicker{},
 		pulse:           pulse,
 		volumeSizeLimit: volumeSizeLimit,
 	}
 }
 
+// SetVolumePicker overrides how PickForWrite chooses among writable
+// volumes, e.g. so the master can switch to WeightedFreePicker via flag.
+func (vl *VolumeLayout) SetVolumePicker(picker VolumePicker) {
+	vl.picker = picker
+}
+
 func (vl *VolumeLayout) RegisterVolume(v *storage.VolumeInfo, dn *DataNode) {
 	if _, ok := vl.vid2location[v.Id]; !ok {
 		vl.vid2location[v.Id] = NewVolumeLocationList()
 	}
+	vl.vid2size[v.Id] = uint64(v.Size)
 	if vl.vid2location[v.Id].Add(dn) {
 		if len(vl.vid2location[v.Id].list) == v.RepType.GetCopyCount() {
 			if vl.isWritable(v) {
@@ -38,6 +48,21 @@ func (vl *VolumeLayout) RegisterVolume(v *storage.VolumeInfo, dn *DataNode) {
 	}
 }
 
+// freeSpace returns how many more bytes vid can take before hitting this
+// layout's volumeSizeLimit, used by the capacity-aware VolumePicker
+// implementations. Volumes this layout has never seen a size report for
+// are treated as empty.
+func (vl *VolumeLayout) freeSpace(vid storage.VolumeId) uint64 {
+	size, ok := vl.vid2size[vid]
+	if !ok {
+		return vl.volumeSizeLimit
+	}
+	if size >= vl.volumeSizeLimit {
+		return 0
+	}
+	return vl.volumeSizeLimit - size
+}
+
 func (vl *VolumeLayout) isWritable(v *storage.VolumeInfo) bool {
 	return uint64(v.Size) < vl.volumeSizeLimit &&
 		v.Version == storage.CurrentVersion &&
@@ -52,12 +77,14 @@ func (vl *VolumeLayout) Lookup(vid storage.VolumeId) []*DataNode {
 }
 
 func (vl *VolumeLayout) PickForWrite(count int) (*storage.VolumeId, int, *VolumeLocationList, error) {
-	len_writers := len(vl.writables)
-	if len_writers <= 0 {
+	if len(vl.writables) <= 0 {
 		fmt.Println("No more writable volumes!")
 		return nil, 0, nil, errors.New("No more writable volumes!")
 	}
-	vid := vl.writables[rand.Intn(len_writers)]
+	vid, err := vl.picker.Pick(vl)
+	if err != nil {
+		return nil, 0, nil, err
+	}
 	locationList := vl.vid2location[vid]
 	if locationList != nil {
 		return &vid, count, locationList, nil
@@ -112,6 +139,32 @@ func (vl *VolumeLayout) SetVolumeCapacityFull(vid storage.VolumeId) bool {
 	return vl.removeFromWritable(vid)
 }
 
+// UnregisterVolume removes a volume from this layout's accounting for one
+// DataNode, as if dn no longer has a replica of vid. Unlike
+// SetVolumeUnavailable, which is for a replica that went missing
+// unexpectedly, this is used when a volume is deliberately unmounted or
+// deleted and should not count towards replication decisions anymore.
+func (vl *VolumeLayout) UnregisterVolume(v *storage.VolumeInfo, dn *DataNode) {
+	vl.removeFromWritable(v.Id)
+	location, ok := vl.vid2location[v.Id]
+	if !ok {
+		return
+	}
+	location.Remove(dn)
+	if location.Length() == 0 {
+		delete(vl.vid2location, v.Id)
+	}
+}
+
+// SetVolumeOffline takes vid out of rotation for writes without touching
+// vid2location, so its replicas keep counting towards replication. Since
+// its DataNodes stay in vid's location list, a later RegisterVolume or
+// SetVolumeAvailable for one of them does not put vid back into rotation:
+// both only do so when Add reports a DataNode newly added to that list.
+func (vl *VolumeLayout) SetVolumeOffline(vid storage.VolumeId) bool {
+	return vl.removeFromWritable(vid)
+}
+
 func (vl *VolumeLayout) ToMap() interface{} {
 	m := make(map[string]interface{})
 	m["replication"] = vl.repType.String()
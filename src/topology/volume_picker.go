@@ -0,0 +1,74 @@
+package topology
+
+import (
+	"errors"
+	"math/rand"
+	"storage"
+)
+
+// VolumePicker chooses which writable volume in vl a new write should
+// land on. Swapping implementations lets the master trade uniform
+// fairness for capacity awareness without touching PickForWrite's callers.
+type VolumePicker interface {
+	Pick(vl *VolumeLayout) (storage.VolumeId, error)
+}
+
+var errNoWritableVolumes = errors.New("No more writable volumes!")
+
+// RandomPicker is the original behavior: every writable volume has an
+// equal chance, regardless of how full it already is.
+type RandomPicker struct{}
+
+func (RandomPicker) Pick(vl *VolumeLayout) (storage.VolumeId, error) {
+	if len(vl.writables) == 0 {
+		return 0, errNoWritableVolumes
+	}
+	return vl.writables[rand.Intn(len(vl.writables))], nil
+}
+
+// WeightedFreePicker favors volumes with more remaining capacity, so
+// writes spread out across the cluster instead of racing the same
+// handful of volumes into SetVolumeCapacityFull while others sit half empty.
+type WeightedFreePicker struct{}
+
+func (WeightedFreePicker) Pick(vl *VolumeLayout) (storage.VolumeId, error) {
+	writables := vl.writables
+	if len(writables) == 0 {
+		return 0, errNoWritableVolumes
+	}
+	weights := make([]uint64, len(writables))
+	var total uint64
+	for i, vid := range writables {
+		// every writable volume keeps some chance, even at "full"
+		weights[i] = vl.freeSpace(vid) + 1
+		total += weights[i]
+	}
+	r := uint64(rand.Int63n(int64(total)))
+	for i, w := range weights {
+		if r < w {
+			return writables[i], nil
+		}
+		r -= w
+	}
+	return writables[len(writables)-1], nil
+}
+
+// LeastLoadedPicker always writes to whichever writable volume currently
+// has the most free space, for operators who want deterministic
+// balancing instead of statistical spread.
+type LeastLoadedPicker struct{}
+
+func (LeastLoadedPicker) Pick(vl *VolumeLayout) (storage.VolumeId, error) {
+	writables := vl.writables
+	if len(writables) == 0 {
+		return 0, errNoWritableVolumes
+	}
+	best := writables[0]
+	bestFree := vl.freeSpace(best)
+	for _, vid := range writables[1:] {
+		if free := vl.freeSpace(vid); free > bestFree {
+			best, bestFree = vid, free
+		}
+	}
+	return best, nil
+}